@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds everything the server needs to run, loaded from a YAML file
+// given via the -config flag. Field names are dashed to match the style of
+// the Apple Music downloader's config.yaml.
+type Config struct {
+	ListenAddr string `yaml:"listen-addr"`
+
+	ImpalaURL        string        `yaml:"impala-url"`
+	ImpalaUsername   string        `yaml:"impala-username"`
+	ImpalaPassword   string        `yaml:"impala-password"`
+	ImpalaSessionTTL time.Duration `yaml:"impala-session-ttl"`
+	ImpalaTimeout    time.Duration `yaml:"impala-timeout"`
+
+	// TrackCacheSize and TrackCacheTTL bound the in-memory cache of
+	// recently-seen tracks and holdings, so repeated lookups (e.g. the
+	// same track appearing in several batch exports) don't re-hit IMPALA.
+	TrackCacheSize int           `yaml:"track-cache-size"`
+	TrackCacheTTL  time.Duration `yaml:"track-cache-ttl"`
+
+	MossURL     string        `yaml:"moss-url"`
+	MossTimeout time.Duration `yaml:"moss-timeout"`
+
+	// StripTags lists the canonical fields (ARTIST, TITLE, ALBUM, LABEL,
+	// DATE, ISRC) that should be rewritten at all. PreserveTags is an
+	// allowlist on top of that: fields named here are always left as
+	// found in the source file, even if they also appear in StripTags.
+	StripTags    []string `yaml:"strip-tags"`
+	PreserveTags []string `yaml:"preserve-tags"`
+
+	// AlbumTemplate, LabelTemplate, DateTemplate, and ISRCTemplate are
+	// text/template strings rendered against a tagTemplateData to produce
+	// the values written for those fields.
+	AlbumTemplate string `yaml:"album-template"`
+	LabelTemplate string `yaml:"label-template"`
+	DateTemplate  string `yaml:"date-template"`
+	ISRCTemplate  string `yaml:"isrc-template"`
+
+	// StripPictures and StripLyrics control whether embedded cover art
+	// and lyrics are removed along with the text tags. EmbedCover and
+	// EmbedLyrics control whether, having stripped them, a neutral
+	// station-supplied replacement is embedded in their place rather
+	// than just leaving the field empty.
+	StripPictures bool `yaml:"strip-pictures"`
+	StripLyrics   bool `yaml:"strip-lyrics"`
+
+	EmbedCover            bool   `yaml:"embed-cover"`
+	ReplacementCoverPath  string `yaml:"replacement-cover-path"`
+	EmbedLyrics           bool   `yaml:"embed-lyrics"`
+	ReplacementLyricsText string `yaml:"replacement-lyrics-text"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:       ":8080",
+		ImpalaSessionTTL: 10 * time.Minute,
+		ImpalaTimeout:    30 * time.Second,
+		TrackCacheSize:   256,
+		TrackCacheTTL:    10 * time.Minute,
+		MossTimeout:      30 * time.Second,
+		StripTags:        []string{"ARTIST", "TITLE", "ALBUM", "LABEL", "DATE", "ISRC"},
+		PreserveTags:     []string{"ARTIST", "TITLE"},
+		AlbumTemplate:    "{{.Holding.Release_Title}}",
+		LabelTemplate:    "{{.Holding.Label}}",
+		DateTemplate:     "{{.Holding.Release_Date}}",
+		ISRCTemplate:     "{{.Holding.ISRC}}",
+		StripPictures:    true,
+		StripLyrics:      true,
+	}
+}
+
+// loadConfig reads and parses the YAML config file at path, starting from
+// defaultConfig so that fields the operator doesn't set keep working.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	if err := yaml.NewDecoder(f).Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// tagSkipSet turns the config's strip-tags/preserve-tags lists into the
+// Skip set a Tagger expects: any canonical field not in strip-tags, or
+// named in preserve-tags, should be left untouched.
+func (c Config) tagSkipSet() map[string]bool {
+	strip := toTagNameSet(c.StripTags)
+	preserve := toTagNameSet(c.PreserveTags)
+
+	skip := make(map[string]bool, len(canonicalTagNames))
+	for _, name := range canonicalTagNames {
+		if !strip[name] || preserve[name] {
+			skip[name] = true
+		}
+	}
+	return skip
+}
+
+func toTagNameSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[strings.ToUpper(n)] = true
+	}
+	return set
+}
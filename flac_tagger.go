@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	flacMagic = "fLaC"
+
+	flacBlockStreamInfo    = 0
+	flacBlockPadding       = 1
+	flacBlockApplication   = 2
+	flacBlockSeekTable     = 3
+	flacBlockVorbisComment = 4
+	flacBlockCueSheet      = 5
+	flacBlockPicture       = 6
+)
+
+// flacBlock is one METADATA_BLOCK from a FLAC file: a type, whether it was
+// the last block in the stream, and its raw payload.
+type flacBlock struct {
+	blockType byte
+	isLast    bool
+	data      []byte
+}
+
+// FlacTagger rewrites the VORBIS_COMMENT metadata block of a FLAC file
+// natively, without shelling out to metaflac. PICTURE blocks are dropped
+// (and optionally replaced) when tags.StripPictures is set; every other
+// metadata block (STREAMINFO, SEEKTABLE, PADDING, ...) and the audio
+// frames are preserved verbatim, so http.ServeContent range requests
+// against the rewritten file keep working exactly as before.
+type FlacTagger struct{}
+
+func (FlacTagger) Strip(path string, tags TagSet) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	blocks, audioOffset, err := readFlacBlocks(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Seek(audioOffset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	audio, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	blocks, err = replaceVorbisComment(blocks, tags)
+	if err != nil {
+		return err
+	}
+	blocks = fixLastFlag(replacePictureBlocks(blocks, tags))
+
+	out, err := ioutil.TempFile("", "dmca-flac")
+	if err != nil {
+		return err
+	}
+	outPath := out.Name()
+
+	if _, err := out.WriteString(flacMagic); err != nil {
+		out.Close()
+		os.Remove(outPath)
+		return err
+	}
+	if err := writeFlacBlocks(out, blocks); err != nil {
+		out.Close()
+		os.Remove(outPath)
+		return err
+	}
+	if _, err := out.Write(audio); err != nil {
+		out.Close()
+		os.Remove(outPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(outPath)
+		return err
+	}
+
+	return replaceFile(path, outPath)
+}
+
+// readFlacBlocks reads the "fLaC" magic and every METADATA_BLOCK that
+// follows it, returning the blocks in file order along with the byte
+// offset at which the audio frames begin.
+func readFlacBlocks(r io.Reader) (blocks []flacBlock, audioOffset int64, err error) {
+	magic := make([]byte, 4)
+	if _, err = io.ReadFull(r, magic); err != nil {
+		return
+	}
+	if string(magic) != flacMagic {
+		err = fmt.Errorf("not a FLAC file")
+		return
+	}
+	audioOffset = int64(len(magic))
+
+	for {
+		header := make([]byte, 4)
+		if _, err = io.ReadFull(r, header); err != nil {
+			return
+		}
+		audioOffset += 4
+
+		isLast := header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+
+		data := make([]byte, length)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return
+		}
+		audioOffset += int64(length)
+
+		blocks = append(blocks, flacBlock{blockType: blockType, isLast: isLast, data: data})
+		if isLast {
+			return
+		}
+	}
+}
+
+// writeFlacBlocks serializes blocks back out as METADATA_BLOCK headers plus
+// payloads, fixing up the last-block flag as it goes.
+func writeFlacBlocks(w io.Writer, blocks []flacBlock) error {
+	for i, b := range blocks {
+		header := make([]byte, 4)
+		if i == len(blocks)-1 {
+			header[0] = 0x80
+		}
+		header[0] |= b.blockType & 0x7f
+		length := len(b.data)
+		header[1] = byte(length >> 16)
+		header[2] = byte(length >> 8)
+		header[3] = byte(length)
+
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.Write(b.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceVorbisComment rewrites (or, if absent, inserts) the
+// VORBIS_COMMENT block to hold tags, leaving every other block untouched.
+// Any existing comment that isn't one of the canonical DMCA fields (e.g.
+// GENRE, ENCODER) is carried over unchanged. If shrinking the comment
+// block frees up space and a PADDING block follows it, the difference is
+// folded into that padding instead of changing the overall metadata size.
+func replaceVorbisComment(blocks []flacBlock, tags TagSet) ([]flacBlock, error) {
+	commentIdx := -1
+	for i, b := range blocks {
+		if b.blockType == flacBlockVorbisComment {
+			commentIdx = i
+			break
+		}
+	}
+
+	vendor := "dmca"
+	var existing []string
+	if commentIdx != -1 {
+		v, c, err := parseVorbisComment(blocks[commentIdx].data)
+		if err != nil {
+			return nil, err
+		}
+		vendor, existing = v, c
+	}
+
+	newComment := buildVorbisComment(vendor, mergeVorbisComments(existing, tags))
+
+	if commentIdx == -1 {
+		out := make([]flacBlock, 0, len(blocks)+1)
+		out = append(out, blocks[0])
+		out = append(out, flacBlock{blockType: flacBlockVorbisComment, data: newComment})
+		out = append(out, blocks[1:]...)
+		return fixLastFlag(out), nil
+	}
+
+	delta := len(blocks[commentIdx].data) - len(newComment)
+	blocks[commentIdx].data = newComment
+
+	if delta > 0 && commentIdx+1 < len(blocks) && blocks[commentIdx+1].blockType == flacBlockPadding {
+		padding := make([]byte, len(blocks[commentIdx+1].data)+delta)
+		copy(padding, blocks[commentIdx+1].data)
+		blocks[commentIdx+1].data = padding
+	}
+
+	return fixLastFlag(blocks), nil
+}
+
+// replacePictureBlocks drops existing PICTURE blocks per tags.StripPictures
+// and appends a replacement front-cover PICTURE block if tags supplies one.
+// Pictures are left alone entirely when StripPictures is false.
+func replacePictureBlocks(blocks []flacBlock, tags TagSet) []flacBlock {
+	if !tags.StripPictures {
+		return blocks
+	}
+
+	out := make([]flacBlock, 0, len(blocks)+1)
+	for _, b := range blocks {
+		if b.blockType == flacBlockPicture {
+			continue
+		}
+		out = append(out, b)
+	}
+
+	if len(tags.ReplacementCover) > 0 {
+		out = append(out, flacBlock{blockType: flacBlockPicture, data: buildFlacPictureBlock(tags.ReplacementCover, tags.ReplacementCoverMime)})
+	}
+
+	return out
+}
+
+// buildFlacPictureBlock encodes a PICTURE metadata block body per the FLAC
+// spec. Unlike VORBIS_COMMENT, PICTURE's integer fields are big-endian.
+// Width/height/depth/colors are left as 0 (unknown), which is valid and
+// what most encoders emit for artwork pulled in after the fact.
+func buildFlacPictureBlock(data []byte, mime string) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(pictureTypeFrontCover))
+	binary.Write(&buf, binary.BigEndian, uint32(len(mime)))
+	buf.WriteString(mime)
+	binary.Write(&buf, binary.BigEndian, uint32(0)) // description length
+	binary.Write(&buf, binary.BigEndian, uint32(0)) // width
+	binary.Write(&buf, binary.BigEndian, uint32(0)) // height
+	binary.Write(&buf, binary.BigEndian, uint32(0)) // color depth
+	binary.Write(&buf, binary.BigEndian, uint32(0)) // number of colors (0 = not indexed)
+	binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func fixLastFlag(blocks []flacBlock) []flacBlock {
+	for i := range blocks {
+		blocks[i].isLast = i == len(blocks)-1
+	}
+	return blocks
+}
+
+// parseVorbisComment decodes a VORBIS_COMMENT block body into its vendor
+// string and raw "KEY=value" comments, per the FLAC/Vorbis spec: all
+// integers little-endian, each string length-prefixed.
+func parseVorbisComment(data []byte) (vendor string, comments []string, err error) {
+	r := bytes.NewReader(data)
+
+	vendor, err = readVorbisString(r)
+	if err != nil {
+		return
+	}
+
+	var n uint32
+	if err = binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return
+	}
+
+	comments = make([]string, 0, n)
+	for i := uint32(0); i < n; i++ {
+		var c string
+		if c, err = readVorbisString(r); err != nil {
+			return
+		}
+		comments = append(comments, c)
+	}
+	return
+}
+
+// buildVorbisComment is the inverse of parseVorbisComment.
+func buildVorbisComment(vendor string, comments []string) []byte {
+	var buf bytes.Buffer
+	writeVorbisString(&buf, vendor)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(comments)))
+	for _, c := range comments {
+		writeVorbisString(&buf, c)
+	}
+	return buf.Bytes()
+}
+
+// mergeVorbisComments applies tags to an existing comment list: canonical
+// DMCA fields (see canonicalTagNames) are replaced, removed, or left alone
+// per tagAction, and anything else passes through untouched. Canonical
+// fields absent from existing are appended if tags supplies a value.
+func mergeVorbisComments(existing []string, tags TagSet) []string {
+	seen := map[string]bool{}
+	result := make([]string, 0, len(existing)+len(canonicalTagNames))
+
+	lyricsSeen := false
+	for _, c := range existing {
+		key, _, ok := splitVorbisComment(c)
+		name := strings.ToUpper(key)
+
+		if ok && isLyricsCommentKey(name) {
+			if !tags.StripLyrics {
+				result = append(result, c)
+			} else if !lyricsSeen && tags.ReplacementLyrics != "" {
+				result = append(result, "LYRICS="+tags.ReplacementLyrics)
+			}
+			lyricsSeen = true
+			continue
+		}
+
+		if !ok || !isCanonicalTagName(name) {
+			result = append(result, c)
+			continue
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if value, touch := tagAction(name, tags); !touch {
+			result = append(result, c)
+		} else if value != "" {
+			result = append(result, name+"="+value)
+		}
+	}
+
+	for _, name := range canonicalTagNames {
+		if seen[name] {
+			continue
+		}
+		if value, touch := tagAction(name, tags); touch && value != "" {
+			result = append(result, name+"="+value)
+		}
+	}
+
+	if !lyricsSeen && tags.StripLyrics && tags.ReplacementLyrics != "" {
+		result = append(result, "LYRICS="+tags.ReplacementLyrics)
+	}
+
+	return result
+}
+
+func splitVorbisComment(c string) (key, value string, ok bool) {
+	idx := strings.IndexByte(c, '=')
+	if idx < 0 {
+		return "", "", false
+	}
+	return c[:idx], c[idx+1:], true
+}
+
+func readVorbisString(r *bytes.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func writeVorbisString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+// replaceFile atomically swaps newPath in for path.
+func replaceFile(path, newPath string) error {
+	if err := os.Rename(newPath, path); err != nil {
+		os.Remove(newPath)
+		return err
+	}
+	return nil
+}
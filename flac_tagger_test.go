@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// TestFlacTaggerRoundTrip builds a minimal FLAC file with a VORBIS_COMMENT
+// block carrying an original artist and a non-canonical GENRE comment,
+// strips it, and checks the canonical field was rewritten, the
+// non-canonical one survived untouched, and the audio bytes weren't
+// touched at all.
+func TestFlacTaggerRoundTrip(t *testing.T) {
+	comment := buildVorbisComment("reference libFLAC 1.3.2", []string{"ARTIST=Old Artist", "GENRE=Rock"})
+	blocks := []flacBlock{
+		{blockType: flacBlockStreamInfo, data: make([]byte, 34)},
+		{blockType: flacBlockVorbisComment, data: comment},
+	}
+
+	var raw bytes.Buffer
+	raw.WriteString(flacMagic)
+	if err := writeFlacBlocks(&raw, blocks); err != nil {
+		t.Fatal(err)
+	}
+	audio := []byte("AUDIOFRAMEDATA")
+	raw.Write(audio)
+
+	tmp := t.TempDir() + "/t.flac"
+	if err := os.WriteFile(tmp, raw.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tags := TagSet{
+		Artist: "Björk",
+		Skip:   map[string]bool{"TITLE": true, "ALBUM": true, "DATE": true, "ISRC": true, "LABEL": true},
+	}
+	if err := (FlacTagger{}).Strip(tmp, tags); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotBlocks, audioOffset, err := readFlacBlocks(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var comments []string
+	for _, b := range gotBlocks {
+		if b.blockType == flacBlockVorbisComment {
+			_, comments, err = parseVorbisComment(b.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	foundArtist, foundGenre := false, false
+	for _, c := range comments {
+		switch c {
+		case "ARTIST=Björk":
+			foundArtist = true
+		case "GENRE=Rock":
+			foundGenre = true
+		case "ARTIST=Old Artist":
+			t.Fatal("original artist should have been replaced")
+		}
+	}
+	if !foundArtist {
+		t.Fatalf("expected rewritten ARTIST comment, got %v", comments)
+	}
+	if !foundGenre {
+		t.Fatalf("expected untouched GENRE comment to survive, got %v", comments)
+	}
+
+	if !bytes.Equal(out[audioOffset:], audio) {
+		t.Fatalf("audio data corrupted: %q", out[audioOffset:])
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// ImpalaClient talks to IMPALA over a single shared *http.Client, reusing
+// the login session cookie across requests instead of logging in again
+// for every track lookup. It also caches recently-seen tracks and holdings
+// for a configurable TTL, since the same few tracks tend to get pulled
+// repeatedly for airplay logs.
+type ImpalaClient struct {
+	baseURL    string
+	username   string
+	password   string
+	sessionTTL time.Duration
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	loggedIn  bool
+	loginedAt time.Time
+
+	tracks   *ttlLRUCache
+	holdings *ttlLRUCache
+}
+
+// newImpalaClient builds an ImpalaClient from the server configuration. It
+// doesn't log in until the first request that needs to.
+func newImpalaClient(cfg Config) (*ImpalaClient, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImpalaClient{
+		baseURL:    cfg.ImpalaURL,
+		username:   cfg.ImpalaUsername,
+		password:   cfg.ImpalaPassword,
+		sessionTTL: cfg.ImpalaSessionTTL,
+		httpClient: &http.Client{
+			Jar:     jar,
+			Timeout: cfg.ImpalaTimeout,
+		},
+		tracks:   newTTLLRUCache(cfg.TrackCacheSize, cfg.TrackCacheTTL),
+		holdings: newTTLLRUCache(cfg.TrackCacheSize, cfg.TrackCacheTTL),
+	}, nil
+}
+
+// ensureSession logs in if we've never logged in, or if the session is
+// older than sessionTTL. The cookie jar on httpClient carries the session
+// cookie IMPALA sets on login to every subsequent request automatically.
+func (c *ImpalaClient) ensureSession() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.loggedIn && time.Since(c.loginedAt) < c.sessionTTL {
+		return nil
+	}
+	return c.login()
+}
+
+// login must be called with c.mu held.
+func (c *ImpalaClient) login() error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/login", c.baseURL), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.username, c.password)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("failed to log in to IMPALA: status %d", resp.StatusCode)
+	}
+
+	c.loggedIn = true
+	c.loginedAt = time.Now()
+	return nil
+}
+
+// forceRelogin drops the cached session so the next request logs in
+// again, for use after a request comes back 401 despite ensureSession
+// thinking the session was still fresh.
+func (c *ImpalaClient) forceRelogin() {
+	c.mu.Lock()
+	c.loggedIn = false
+	c.mu.Unlock()
+}
+
+// get issues an authenticated GET against path, retrying once after a
+// fresh login if the session had expired server-side.
+func (c *ImpalaClient) get(path string) (*http.Response, error) {
+	if err := c.ensureSession(); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Get(c.baseURL + path)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		c.forceRelogin()
+		if err := c.ensureSession(); err != nil {
+			return nil, err
+		}
+		resp, err = c.httpClient.Get(c.baseURL + path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+// GetTrack fetches a track's metadata, serving from cache when possible.
+func (c *ImpalaClient) GetTrack(trackID string) (*TrackJSON, error) {
+	if cached, ok := c.tracks.Get(trackID); ok {
+		return cached.(*TrackJSON), nil
+	}
+
+	resp, err := c.get(fmt.Sprintf("/api/v1/tracks/%s", trackID))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, TrackNotFoundError{trackID}
+	} else if resp.StatusCode != 200 {
+		return nil, TrackFetchError{trackID}
+	}
+
+	data := &TrackJSON{}
+	if err := json.NewDecoder(resp.Body).Decode(data); err != nil {
+		return nil, err
+	}
+
+	c.tracks.Set(trackID, data)
+	return data, nil
+}
+
+// GetHolding fetches the holding (release) a track belongs to, serving
+// from cache when possible.
+func (c *ImpalaClient) GetHolding(holdingID string) (*HoldingJSON, error) {
+	if cached, ok := c.holdings.Get(holdingID); ok {
+		return cached.(*HoldingJSON), nil
+	}
+
+	resp, err := c.get(fmt.Sprintf("/api/v1/holdings/%s", holdingID))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, TrackNotFoundError{holdingID}
+	} else if resp.StatusCode != 200 {
+		return nil, TrackFetchError{holdingID}
+	}
+
+	data := &HoldingJSON{}
+	if err := json.NewDecoder(resp.Body).Decode(data); err != nil {
+		return nil, err
+	}
+
+	c.holdings.Set(holdingID, data)
+	return data, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ttlLRUCache is a small fixed-size, TTL-expiring cache shared by
+// ImpalaClient's track and holding lookups. Values are stored as
+// interface{} since the entry shape (TrackJSON vs HoldingJSON) differs
+// between the two uses.
+type ttlLRUCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type ttlLRUEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newTTLLRUCache(capacity int, ttl time.Duration) *ttlLRUCache {
+	return &ttlLRUCache{
+		capacity: capacity,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *ttlLRUCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*ttlLRUEntry)
+	if time.Now().After(entry.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *ttlLRUCache) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*ttlLRUEntry).value = value
+		el.Value.(*ttlLRUEntry).expires = expires
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&ttlLRUEntry{key: key, value: value, expires: expires})
+	c.items[key] = el
+
+	if c.capacity > 0 && c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*ttlLRUEntry).key)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -8,24 +10,14 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"regexp"
-	"strings"
+	"text/template"
 	"time"
-
-	"golang.org/x/net/publicsuffix"
 )
 
-var config struct {
-	impalaURL      string
-	impalaUsername string
-	impalaPassword string
-	mossURL        string
-}
-
 type TrackNotFoundError struct {
 	ID string
 }
@@ -57,133 +49,436 @@ type TrackJSON struct {
 	Track_Num      uint64
 }
 
-func loadTrackInfo(trackID string) (data *TrackJSON, err error) {
-	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
-	if err != nil {
-		return
+// HoldingJSON is the subset of IMPALA's holding (release) record needed to
+// fill in the legally-required ALBUM/LABEL/DATE/ISRC tags for a track.
+type HoldingJSON struct {
+	ID            string
+	Release_Title string
+	Label         string
+	Release_Date  string
+	ISRC          string
+}
+
+// server holds everything the HTTP handlers need: the loaded config and
+// the long-lived IMPALA client they share, rather than each request
+// building its own session and connection from scratch.
+type server struct {
+	cfg    Config
+	impala *ImpalaClient
+
+	// replacementCover and replacementCoverMime hold the station's
+	// neutral cover image, loaded once at startup, for embedding in
+	// place of a track's original artwork when embed-cover is set.
+	replacementCover     []byte
+	replacementCoverMime string
+}
+
+// loadReplacementCover reads the configured replacement cover image, if
+// any, and sniffs its MIME type so taggers can embed it with the right
+// picture format.
+func loadReplacementCover(cfg Config) ([]byte, string, error) {
+	if !cfg.EmbedCover || cfg.ReplacementCoverPath == "" {
+		return nil, "", nil
 	}
 
-	client := &http.Client{
-		Jar: jar,
+	data, err := ioutil.ReadFile(cfg.ReplacementCoverPath)
+	if err != nil {
+		return nil, "", err
 	}
+	return data, http.DetectContentType(data), nil
+}
 
-	loginReq, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/login", config.impalaURL), nil)
+// fetchTrackFile downloads the holding's copy of a track from MOSS into a
+// local temporary file and returns its path. The caller is responsible for
+// removing the file once it's done with it.
+func (s *server) fetchTrackFile(track *TrackJSON) (path string, err error) {
+	client := &http.Client{Timeout: s.cfg.MossTimeout}
+
+	resp, err := client.Get(fmt.Sprintf("%s/%s/music/%s", s.cfg.MossURL, url.PathEscape(track.Holding_ID), url.PathEscape(track.File_Path)))
 	if err != nil {
 		return
 	}
-	loginReq.SetBasicAuth(config.impalaUsername, config.impalaPassword)
-	loginResp, err := client.Do(loginReq)
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("failed to access track %s: status %d", track.ID, resp.StatusCode)
+		return
+	}
+
+	tmpf, err := ioutil.TempFile("", "dmca")
 	if err != nil {
 		return
 	}
-	defer loginResp.Body.Close()
+	defer tmpf.Close()
+	path = tmpf.Name()
+
+	if _, err = io.Copy(tmpf, resp.Body); err != nil {
+		os.Remove(path)
+		path = ""
+		return
+	}
+
+	return
+}
+
+// tagTemplateData is the data available to the album/label/date/isrc
+// templates in Config.
+type tagTemplateData struct {
+	Track   *TrackJSON
+	Holding *HoldingJSON
+}
+
+// renderTagTemplate executes a text/template string from Config against a
+// track and its holding.
+func renderTagTemplate(text string, data tagTemplateData) (string, error) {
+	tmpl, err := template.New("tag").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// buildTagSet renders the configured templates against track and holding
+// to produce the TagSet a Tagger should write, honoring the config's
+// strip-tags/preserve-tags policy.
+func (s *server) buildTagSet(track *TrackJSON, holding *HoldingJSON) (TagSet, error) {
+	data := tagTemplateData{Track: track, Holding: holding}
 
-	// make the request to impala
-	resp, err := client.Get(fmt.Sprintf("%s/api/v1/tracks/%s", config.impalaURL, trackID))
+	album, err := renderTagTemplate(s.cfg.AlbumTemplate, data)
+	if err != nil {
+		return TagSet{}, err
+	}
+	label, err := renderTagTemplate(s.cfg.LabelTemplate, data)
+	if err != nil {
+		return TagSet{}, err
+	}
+	date, err := renderTagTemplate(s.cfg.DateTemplate, data)
+	if err != nil {
+		return TagSet{}, err
+	}
+	isrc, err := renderTagTemplate(s.cfg.ISRCTemplate, data)
+	if err != nil {
+		return TagSet{}, err
+	}
+
+	tags := TagSet{
+		Artist:        track.Artist,
+		Title:         track.Title,
+		Album:         album,
+		Label:         label,
+		Date:          date,
+		ISRC:          isrc,
+		Skip:          s.cfg.tagSkipSet(),
+		StripPictures: s.cfg.StripPictures,
+		StripLyrics:   s.cfg.StripLyrics,
+	}
+
+	if s.cfg.EmbedCover {
+		tags.ReplacementCover = s.replacementCover
+		tags.ReplacementCoverMime = s.replacementCoverMime
+	}
+	if s.cfg.EmbedLyrics {
+		tags.ReplacementLyrics = s.cfg.ReplacementLyricsText
+	}
+
+	return tags, nil
+}
+
+// stripTrackTags rewrites the ARTIST/TITLE/ALBUM/LABEL/DATE/ISRC tags on
+// the track file at path in place, dispatching to a format-appropriate
+// Tagger based on the track's library path. It returns the TagSet that was
+// applied, so callers can report exactly what was (or wasn't) changed.
+func (s *server) stripTrackTags(track *TrackJSON, holding *HoldingJSON, path string) (TagSet, error) {
+	tagger, err := taggerForPath(track.File_Path)
+	if err != nil {
+		return TagSet{}, err
+	}
+
+	tags, err := s.buildTagSet(track, holding)
+	if err != nil {
+		return TagSet{}, err
+	}
+
+	if err := tagger.Strip(path, tags); err != nil {
+		return TagSet{}, err
+	}
+	return tags, nil
+}
+
+// sanitizeTrack loads a track's metadata and holding information from
+// IMPALA, downloads the corresponding file from MOSS, and strips its tags
+// in place. The returned path points at a temporary file the caller must
+// remove. holding and tags are also returned so callers can report what
+// was actually done to the track, not just whether it succeeded.
+func (s *server) sanitizeTrack(trackID string) (track *TrackJSON, holding *HoldingJSON, tags TagSet, path string, err error) {
+	track, err = s.impala.GetTrack(trackID)
 	if err != nil {
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == 404 {
-		err = TrackNotFoundError{trackID}
+	holding, err = s.impala.GetHolding(track.Holding_ID)
+	if err != nil {
 		return
-	} else if resp.StatusCode != 200 {
-		err = TrackFetchError{trackID}
+	}
+
+	path, err = s.fetchTrackFile(track)
+	if err != nil {
 		return
 	}
 
-	data = &TrackJSON{}
-	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(data)
+	tags, err = s.stripTrackTags(track, holding, path)
+	if err != nil {
+		os.Remove(path)
+		path = ""
+	}
 	return
 }
 
-func trackHandler(w http.ResponseWriter, r *http.Request) {
+var trackRe = regexp.MustCompile(`^/track/(?P<uuid>[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12})\.\w+$`)
+
+// trackIDRe matches a bare track UUID, with no surrounding path or
+// extension: the same shape trackRe extracts from /track/ URLs, used to
+// validate track IDs arriving in other ways (e.g. a batch request body)
+// before they reach an IMPALA lookup.
+var trackIDRe = regexp.MustCompile(`^[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}$`)
+
+func (s *server) trackHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	trackRe := regexp.MustCompile("^/track/(?P<uuid>[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}).flac$")
 	match := trackRe.FindStringSubmatch(r.URL.Path)
 	if len(match) < 2 {
 		http.NotFound(w, r)
 		return
 	}
 
-	track, err := loadTrackInfo(match[1])
+	track, _, _, path, err := s.sanitizeTrack(match[1])
 	if _, ok := err.(TrackNotFoundError); ok {
 		http.NotFound(w, r)
 		return
 	} else if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Failed to load track information: %v\n", err)
+		log.Printf("Failed to prepare track: %v\n", err)
 		return
 	}
+	defer os.Remove(path)
 
-	resp, err := http.Get(fmt.Sprintf("%s/%s/music/%s", config.mossURL, url.PathEscape(track.Holding_ID), url.PathEscape(track.File_Path)))
-	if err != nil || resp.StatusCode != 200 {
+	f, err := os.Open(path)
+	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Failed to access track: %v\n", err)
+		log.Printf("Failed to load track: %v\n", err)
 		return
 	}
-	defer resp.Body.Close()
+	defer f.Close()
 
-	tmpf, err := ioutil.TempFile("", "dmca")
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Failed to create temporary file: %v\n", err)
+	http.ServeContent(w, r, track.ID+filepath.Ext(track.File_Path), time.Now(), f)
+}
+
+// BatchRequest is the body accepted by batchHandler: a flat list of track
+// UUIDs to sanitize and bundle together.
+type BatchRequest struct {
+	Tracks []string `json:"tracks"`
+}
+
+const (
+	// maxBatchRequestBytes bounds how much of a batch POST body we'll
+	// read, since unlike the single-track handler this endpoint accepts
+	// a request body at all and it's otherwise unbounded.
+	maxBatchRequestBytes = 1 << 20 // 1 MiB
+
+	// maxBatchTracks bounds how many tracks a single batch request can
+	// ask for, independent of body size, so a request packed with many
+	// short UUIDs can't still force an unbounded amount of downstream
+	// work.
+	maxBatchTracks = 500
+)
+
+// BatchManifestEntry records what happened to a single track within a batch
+// export, for the station's own audit trail of what was scrubbed. The
+// Original*/Sanitized* pairs cover every field stripTrackTags can rewrite,
+// not just ARTIST/TITLE, so the manifest actually reflects what changed.
+type BatchManifestEntry struct {
+	UUID             string `json:"uuid"`
+	OriginalArtist   string `json:"original_artist,omitempty"`
+	OriginalTitle    string `json:"original_title,omitempty"`
+	OriginalAlbum    string `json:"original_album,omitempty"`
+	OriginalLabel    string `json:"original_label,omitempty"`
+	OriginalDate     string `json:"original_date,omitempty"`
+	OriginalISRC     string `json:"original_isrc,omitempty"`
+	SanitizedArtist  string `json:"sanitized_artist,omitempty"`
+	SanitizedTitle   string `json:"sanitized_title,omitempty"`
+	SanitizedAlbum   string `json:"sanitized_album,omitempty"`
+	SanitizedLabel   string `json:"sanitized_label,omitempty"`
+	SanitizedDate    string `json:"sanitized_date,omitempty"`
+	SanitizedISRC    string `json:"sanitized_isrc,omitempty"`
+	StrippedPictures bool   `json:"stripped_pictures,omitempty"`
+	StrippedLyrics   bool   `json:"stripped_lyrics,omitempty"`
+	ArchivePath      string `json:"archive_path,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// manifestFieldAfter reports the value recorded for a canonical field
+// after sanitizing: tags' rendered value (possibly empty, meaning removed)
+// if tagAction rewrites the field, or original otherwise. original is the
+// IMPALA value passed in; the file's own tag is not read, so for a field
+// left alone this is IMPALA's value rather than what the file carries.
+func manifestFieldAfter(name, original string, tags TagSet) string {
+	value, touch := tagAction(name, tags)
+	if !touch {
+		return original
+	}
+	return value
+}
+
+// batchHandler accepts a POST of track UUIDs and streams back a ZIP archive
+// containing each sanitized track plus a manifest.json describing what was
+// done to each one, including any that failed or weren't found. Tracks
+// are processed and written to the archive one at a time so memory use
+// stays bounded regardless of playlist size.
+func (s *server) batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	defer os.Remove(tmpf.Name())
 
-	if _, err := io.Copy(tmpf, resp.Body); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Failed to download track: %v\n", err)
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchRequestBytes)
+
+	var req BatchRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
-	if err := tmpf.Close(); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Failed to close temporary file: %v\n", err)
+	if len(req.Tracks) > maxBatchTracks {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
 
-	cmd := exec.Command("metaflac", "--remove-tag=ARTIST", "--remove-tag=TITLE", "--remove-tag=ALBUM", "--remove-tag=LABEL", "--import-tags-from=-", tmpf.Name())
-	// FIXME: actually use the data from impala here for the album and label
-	cmd.Stdin = strings.NewReader(fmt.Sprintf("ARTIST=%s\nTITLE=%s\nALBUM=dmca test\nLABEL=dmca test\n", track.Artist, track.Title))
-	if err := cmd.Run(); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Failed to modify track metadata: %v\n", err)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="tracks.zip"`)
+
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	manifest := make([]BatchManifestEntry, 0, len(req.Tracks))
+	for _, uuid := range req.Tracks {
+		entry := BatchManifestEntry{UUID: uuid}
+
+		if !trackIDRe.MatchString(uuid) {
+			entry.Error = "invalid track id"
+			manifest = append(manifest, entry)
+			continue
+		}
+
+		track, holding, tags, path, err := s.sanitizeTrack(uuid)
+		if err != nil {
+			if _, ok := err.(TrackNotFoundError); ok {
+				entry.Error = "track not found"
+			} else {
+				entry.Error = err.Error()
+				log.Printf("Failed to prepare track %s for batch export: %v\n", uuid, err)
+			}
+			manifest = append(manifest, entry)
+			continue
+		}
+
+		entry.OriginalArtist = track.Artist
+		entry.OriginalTitle = track.Title
+		entry.OriginalAlbum = holding.Release_Title
+		entry.OriginalLabel = holding.Label
+		entry.OriginalDate = holding.Release_Date
+		entry.OriginalISRC = holding.ISRC
+
+		entry.SanitizedArtist = manifestFieldAfter("ARTIST", track.Artist, tags)
+		entry.SanitizedTitle = manifestFieldAfter("TITLE", track.Title, tags)
+		entry.SanitizedAlbum = manifestFieldAfter("ALBUM", holding.Release_Title, tags)
+		entry.SanitizedLabel = manifestFieldAfter("LABEL", holding.Label, tags)
+		entry.SanitizedDate = manifestFieldAfter("DATE", holding.Release_Date, tags)
+		entry.SanitizedISRC = manifestFieldAfter("ISRC", holding.ISRC, tags)
+		entry.StrippedPictures = tags.StripPictures
+		entry.StrippedLyrics = tags.StripLyrics
+
+		entry.ArchivePath = fmt.Sprintf("tracks/%s%s", track.ID, filepath.Ext(track.File_Path))
+
+		if err := appendTrackToZip(zw, entry.ArchivePath, path); err != nil {
+			os.Remove(path)
+			entry.ArchivePath = ""
+			entry.Error = err.Error()
+			log.Printf("Failed to archive track %s for batch export: %v\n", uuid, err)
+			manifest = append(manifest, entry)
+			continue
+		}
+		os.Remove(path)
+
+		manifest = append(manifest, entry)
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Printf("Failed to marshal batch manifest: %v\n", err)
 		return
 	}
 
-	f, err := os.Open(tmpf.Name())
+	mw, err := zw.Create("manifest.json")
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Failed to load track: %v\n", err)
+		log.Printf("Failed to write batch manifest: %v\n", err)
 		return
 	}
+	if _, err := mw.Write(manifestJSON); err != nil {
+		log.Printf("Failed to write batch manifest: %v\n", err)
+	}
+}
+
+// appendTrackToZip copies the file at path into the archive under name,
+// streaming it directly into the zip writer rather than buffering it.
+func appendTrackToZip(zw *zip.Writer, name string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
 
-	http.ServeContent(w, r, fmt.Sprintf("%s.flac", track.ID), time.Now(), f)
+	zf, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(zf, f)
+	return err
 }
 
 func main() {
-	flag.StringVar(&config.impalaURL, "impalaurl", "",
-		"URL to IMPALA instance")
-	flag.StringVar(&config.impalaUsername, "impalauser", "",
-		"Username to use for IMPALA access")
-	flag.StringVar(&config.impalaPassword, "impalapassword", "",
-		"Password to use for IMPALA access")
-	flag.StringVar(&config.mossURL, "mossurl", "",
-		"URL to MOSS instance")
+	configPath := flag.String("config", "config.yaml", "Path to configuration file")
 	flag.Parse()
 
-	if config.impalaURL == "" {
-		log.Fatal("URL to IMPALA instance must be provided.")
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration from %s: %v", *configPath, err)
+	}
+
+	if cfg.ImpalaURL == "" {
+		log.Fatal("impala-url must be set in the configuration file")
 	}
 
-	http.HandleFunc("/track/", trackHandler)
-	http.ListenAndServe(":8080", nil)
+	impala, err := newImpalaClient(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up IMPALA client: %v", err)
+	}
+
+	cover, coverMime, err := loadReplacementCover(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load replacement cover %s: %v", cfg.ReplacementCoverPath, err)
+	}
+
+	s := &server{cfg: cfg, impala: impala, replacementCover: cover, replacementCoverMime: coverMime}
+
+	http.HandleFunc("/track/", s.trackHandler)
+	http.HandleFunc("/batch/", s.batchHandler)
+	log.Fatal(http.ListenAndServe(cfg.ListenAddr, nil))
 }
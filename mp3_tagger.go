@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	id3v2Header = "ID3"
+	id3v1Tag    = "TAG"
+	id3v1Size   = 128
+
+	id3FrameAPIC = "APIC"
+	id3FrameUSLT = "USLT"
+)
+
+// id3Frames maps each canonical tag name to the ID3v2 frame that carries
+// it. There's no standard "label" frame; TPUB (publisher) is the closest
+// fit and is what most taggers repurpose for it.
+var id3Frames = map[string]string{
+	"ARTIST": "TPE1",
+	"TITLE":  "TIT2",
+	"ALBUM":  "TALB",
+	"LABEL":  "TPUB",
+	"DATE":   "TDRC",
+	"ISRC":   "TSRC",
+}
+
+var id3FrameTagNames = reverseStringMap(id3Frames)
+
+func reverseStringMap(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[v] = k
+	}
+	return out
+}
+
+// id3v2Frame is a single ID3v2 frame: a 4-character identifier and its raw
+// payload (flags are dropped, since we never need to preserve them for the
+// text frames we rewrite).
+type id3v2Frame struct {
+	id   string
+	body []byte
+}
+
+// Mp3Tagger rewrites the ID3v2 text frames that identify a track (and
+// drops any trailing ID3v1 tag, which can't express the full TagSet) in
+// place, leaving the MPEG audio frames untouched.
+type Mp3Tagger struct{}
+
+func (Mp3Tagger) Strip(path string, tags TagSet) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	audio := stripID3v1(raw)
+
+	frames, headerLen := readID3v2Frames(audio)
+	audio = audio[headerLen:]
+
+	frames = mergeID3Frames(frames, tags)
+	frames = replaceArtworkFrames(frames, tags)
+
+	out, err := ioutil.TempFile("", "dmca-mp3")
+	if err != nil {
+		return err
+	}
+	outPath := out.Name()
+
+	if err := writeID3v2(out, frames); err != nil {
+		out.Close()
+		os.Remove(outPath)
+		return err
+	}
+	if _, err := out.Write(audio); err != nil {
+		out.Close()
+		os.Remove(outPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(outPath)
+		return err
+	}
+
+	return replaceFile(path, outPath)
+}
+
+// stripID3v1 drops a trailing 128-byte "TAG"-prefixed ID3v1 tag, if present.
+func stripID3v1(data []byte) []byte {
+	if len(data) < id3v1Size {
+		return data
+	}
+	tail := data[len(data)-id3v1Size:]
+	if string(tail[:3]) == id3v1Tag {
+		return data[:len(data)-id3v1Size]
+	}
+	return data
+}
+
+// readID3v2Frames parses an ID3v2.3/2.4 header (if present) and its text
+// frames, returning them along with the total size of the tag (header plus
+// frames plus any padding) so the caller can skip past it to the audio.
+func readID3v2Frames(data []byte) (frames []id3v2Frame, headerLen int) {
+	if len(data) < 10 || string(data[:3]) != id3v2Header {
+		return nil, 0
+	}
+
+	tagSize := decodeSyncSafe(data[6:10])
+	headerLen = 10 + tagSize
+	if headerLen > len(data) {
+		headerLen = len(data)
+	}
+	version := data[3]
+
+	body := data[10:headerLen]
+	for len(body) >= 10 {
+		id := string(body[0:4])
+		if id == "\x00\x00\x00\x00" {
+			break
+		}
+
+		var size int
+		if version >= 4 {
+			size = decodeSyncSafe(body[4:8])
+		} else {
+			size = int(binary.BigEndian.Uint32(body[4:8]))
+		}
+		if size < 0 || 10+size > len(body) {
+			break
+		}
+
+		frames = append(frames, id3v2Frame{id: id, body: body[10 : 10+size]})
+		body = body[10+size:]
+	}
+
+	return frames, headerLen
+}
+
+func decodeSyncSafe(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
+
+func encodeSyncSafe(n int) []byte {
+	return []byte{
+		byte((n >> 21) & 0x7f),
+		byte((n >> 14) & 0x7f),
+		byte((n >> 7) & 0x7f),
+		byte(n & 0x7f),
+	}
+}
+
+// mergeID3Frames applies tags to an existing frame list: frames that map
+// to a canonical DMCA field are replaced, removed, or left alone per
+// tagAction, and every other frame (COMM, TCON, APIC, ...) passes through
+// untouched. Canonical fields with no existing frame are appended if tags
+// supplies a value.
+func mergeID3Frames(frames []id3v2Frame, tags TagSet) []id3v2Frame {
+	seen := map[string]bool{}
+	out := make([]id3v2Frame, 0, len(frames)+len(canonicalTagNames))
+
+	for _, fr := range frames {
+		name, ok := id3FrameTagNames[fr.id]
+		if !ok {
+			out = append(out, fr)
+			continue
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if value, touch := tagAction(name, tags); !touch {
+			out = append(out, fr)
+		} else if value != "" {
+			out = append(out, textFrame(fr.id, value))
+		}
+	}
+
+	for _, name := range canonicalTagNames {
+		if seen[name] {
+			continue
+		}
+		if value, touch := tagAction(name, tags); touch && value != "" {
+			out = append(out, textFrame(id3Frames[name], value))
+		}
+	}
+
+	return out
+}
+
+// replaceArtworkFrames drops existing APIC (picture) and USLT (lyrics)
+// frames per tags.StripPictures/StripLyrics, appending a replacement frame
+// for each if tags supplies one. A frame kind is left alone entirely when
+// its strip flag is false.
+func replaceArtworkFrames(frames []id3v2Frame, tags TagSet) []id3v2Frame {
+	out := make([]id3v2Frame, 0, len(frames)+2)
+
+	for _, fr := range frames {
+		switch fr.id {
+		case id3FrameAPIC:
+			if !tags.StripPictures {
+				out = append(out, fr)
+			}
+		case id3FrameUSLT:
+			if !tags.StripLyrics {
+				out = append(out, fr)
+			}
+		default:
+			out = append(out, fr)
+		}
+	}
+
+	if tags.StripPictures && len(tags.ReplacementCover) > 0 {
+		out = append(out, buildAPICFrame(tags.ReplacementCoverMime, tags.ReplacementCover))
+	}
+	if tags.StripLyrics && tags.ReplacementLyrics != "" {
+		out = append(out, buildUSLTFrame(tags.ReplacementLyrics))
+	}
+
+	return out
+}
+
+// id3EncodingUTF8 is the ID3v2.4 text-encoding byte for UTF-8. Track
+// metadata routinely contains non-ASCII text, so every frame here is
+// written as UTF-8 and labeled accordingly rather than mislabeled as
+// ISO-8859-1 (encoding byte 0x00), which would read back as mojibake.
+const id3EncodingUTF8 = 0x03
+
+// buildAPICFrame builds an APIC (attached picture) frame body: a UTF-8
+// encoding byte, null-terminated MIME type, a picture-type byte, a
+// null-terminated (empty) description, then the raw image data.
+func buildAPICFrame(mime string, data []byte) id3v2Frame {
+	body := make([]byte, 0, 3+len(mime)+len(data))
+	body = append(body, id3EncodingUTF8)
+	body = append(body, []byte(mime)...)
+	body = append(body, 0x00)
+	body = append(body, byte(pictureTypeFrontCover))
+	body = append(body, 0x00) // empty description
+	body = append(body, data...)
+	return id3v2Frame{id: id3FrameAPIC, body: body}
+}
+
+// buildUSLTFrame builds a USLT (unsynchronized lyrics) frame body: a
+// UTF-8 encoding byte, a 3-letter language code, a null-terminated (empty)
+// content descriptor, then the lyrics text.
+func buildUSLTFrame(text string) id3v2Frame {
+	body := make([]byte, 0, 5+len(text))
+	body = append(body, id3EncodingUTF8)
+	body = append(body, []byte("eng")...)
+	body = append(body, 0x00) // empty content descriptor
+	body = append(body, []byte(text)...)
+	return id3v2Frame{id: id3FrameUSLT, body: body}
+}
+
+// textFrame builds a UTF-8 text frame body (the 1-byte encoding
+// indicator, followed by the raw text).
+func textFrame(id string, value string) id3v2Frame {
+	return id3v2Frame{id: id, body: append([]byte{id3EncodingUTF8}, []byte(value)...)}
+}
+
+// writeID3v2 serializes frames as an ID3v2.4 tag with no padding.
+func writeID3v2(w io.Writer, frames []id3v2Frame) error {
+	var body bytes.Buffer
+	for _, fr := range frames {
+		body.WriteString(fr.id)
+		body.Write(encodeSyncSafe(len(fr.body)))
+		body.Write([]byte{0x00, 0x00}) // flags
+		body.Write(fr.body)
+	}
+
+	header := make([]byte, 10)
+	copy(header[0:3], id3v2Header)
+	header[3] = 4 // ID3v2.4
+	header[4] = 0
+	copy(header[6:10], encodeSyncSafe(body.Len()))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
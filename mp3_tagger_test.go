@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// TestMp3TaggerRoundTrip builds a minimal ID3v2.4 tag with an original
+// artist frame and a non-canonical comment frame plus a trailing ID3v1
+// tag, strips it with a non-ASCII replacement artist, and checks the
+// canonical frame was rewritten as valid UTF-8, the non-canonical frame
+// survived, the ID3v1 tag was dropped, and the audio bytes weren't
+// touched at all.
+func TestMp3TaggerRoundTrip(t *testing.T) {
+	frames := []id3v2Frame{
+		textFrame("TPE1", "Old Artist"),
+		{id: "COMM", body: append([]byte{0x00, 'e', 'n', 'g', 0x00}, []byte("a comment")...)},
+	}
+
+	var raw bytes.Buffer
+	if err := writeID3v2(&raw, frames); err != nil {
+		t.Fatal(err)
+	}
+	audio := []byte("MPEGFRAMEDATA")
+	raw.Write(audio)
+	raw.WriteString("TAG")
+	raw.Write(make([]byte, id3v1Size-3))
+
+	tmp := t.TempDir() + "/t.mp3"
+	if err := os.WriteFile(tmp, raw.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tags := TagSet{
+		Artist: "Björk",
+		Skip:   map[string]bool{"TITLE": true, "ALBUM": true, "DATE": true, "ISRC": true, "LABEL": true},
+	}
+	if err := (Mp3Tagger{}).Strip(tmp, tags); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotFrames, headerLen := readID3v2Frames(out)
+
+	var sawArtist, sawComment bool
+	for _, fr := range gotFrames {
+		switch fr.id {
+		case "TPE1":
+			sawArtist = true
+			if fr.body[0] != id3EncodingUTF8 {
+				t.Fatalf("expected UTF-8 encoding byte, got %#x", fr.body[0])
+			}
+			if string(fr.body[1:]) != "Björk" {
+				t.Fatalf("expected rewritten artist, got %q", fr.body[1:])
+			}
+		case "COMM":
+			sawComment = true
+		}
+	}
+	if !sawArtist {
+		t.Fatal("expected a rewritten TPE1 frame")
+	}
+	if !sawComment {
+		t.Fatal("expected the untouched COMM frame to survive")
+	}
+
+	rest := out[headerLen:]
+	if !bytes.Equal(rest, audio) {
+		t.Fatalf("expected ID3v1 tag to be dropped and audio preserved, got %q", rest)
+	}
+}
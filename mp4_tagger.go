@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// mp4Box is one ISO base media file format box: a four-character type and
+// its payload (everything after the 8-byte size+type header).
+type mp4Box struct {
+	typ     string
+	payload []byte
+}
+
+const (
+	itunesMean   = "com.apple.iTunes"
+	atomFreeform = "----"
+	atomArtist   = "\xa9ART"
+	atomTitle    = "\xa9nam"
+	atomAlbum    = "\xa9alb"
+	atomDate     = "\xa9day"
+	atomCover    = "covr"
+	atomLyrics   = "\xa9lyr"
+
+	// mp4DataTypeJPEG and mp4DataTypePNG are the iTunes "data" atom
+	// well-known type codes for cover art; anything else falls back to 0
+	// (reserved/implicit), which players generally still sniff correctly.
+	mp4DataTypeJPEG = 13
+	mp4DataTypePNG  = 14
+)
+
+// mp4Atoms maps each canonical tag name with a dedicated iTunes atom to
+// that atom's fourcc. Fields with no dedicated atom (LABEL, ISRC) are
+// instead stored as "----" freeform atoms, keyed by name within the
+// freeform mean="com.apple.iTunes" namespace.
+var mp4Atoms = map[string]string{
+	"ARTIST": atomArtist,
+	"TITLE":  atomTitle,
+	"ALBUM":  atomAlbum,
+	"DATE":   atomDate,
+}
+
+var mp4AtomTagNames = reverseStringMap(mp4Atoms)
+
+// Mp4Tagger rewrites the iTunes-style metadata atoms nested under
+// moov/udta/meta/ilst in an MP4/M4A file. There's no standard atom for a
+// record label, so it's stored the way iTunes stores any field it doesn't
+// have a dedicated atom for: a "----" freeform atom carrying
+// mean="com.apple.iTunes", name="LABEL".
+type Mp4Tagger struct{}
+
+func (Mp4Tagger) Strip(path string, tags TagSet) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	top, err := parseBoxes(raw)
+	if err != nil {
+		return err
+	}
+
+	moovIdx := indexOfBox(top, "moov")
+	if moovIdx == -1 {
+		return fmt.Errorf("no moov box found")
+	}
+
+	newMoov, err := rewriteMoov(top[moovIdx].payload, tags)
+	if err != nil {
+		return err
+	}
+
+	// Rewriting moov's ilst can change moov's size, which shifts the
+	// absolute file offset of everything after it - including mdat, the
+	// box stco/co64 (nested under trak/mdia/minf/stbl) point into. If
+	// mdat comes after moov, as it does in any "faststart" file, those
+	// chunk offset tables need to shift by the same delta or every
+	// sample in the file ends up pointing at the wrong bytes.
+	if delta := int64(len(newMoov)) - int64(len(top[moovIdx].payload)); delta != 0 {
+		if mdatIdx := indexOfBox(top, "mdat"); mdatIdx > moovIdx {
+			if newMoov, err = adjustChunkOffsets(newMoov, delta); err != nil {
+				return err
+			}
+		}
+	}
+
+	top[moovIdx].payload = newMoov
+
+	out, err := ioutil.TempFile("", "dmca-mp4")
+	if err != nil {
+		return err
+	}
+	outPath := out.Name()
+
+	if err := writeBoxes(out, top); err != nil {
+		out.Close()
+		os.Remove(outPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(outPath)
+		return err
+	}
+
+	return replaceFile(path, outPath)
+}
+
+func rewriteMoov(payload []byte, tags TagSet) ([]byte, error) {
+	children, err := parseBoxes(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	udtaIdx := indexOfBox(children, "udta")
+	if udtaIdx == -1 {
+		children = append(children, mp4Box{typ: "udta"})
+		udtaIdx = len(children) - 1
+	}
+
+	newUdta, err := rewriteUdta(children[udtaIdx].payload, tags)
+	if err != nil {
+		return nil, err
+	}
+	children[udtaIdx].payload = newUdta
+
+	return encodeBoxes(children), nil
+}
+
+func rewriteUdta(payload []byte, tags TagSet) ([]byte, error) {
+	children, err := parseBoxes(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	metaIdx := indexOfBox(children, "meta")
+	if metaIdx == -1 {
+		children = append(children, mp4Box{typ: "meta", payload: make([]byte, 4)})
+		metaIdx = len(children) - 1
+	}
+
+	newMeta, err := rewriteMeta(children[metaIdx].payload, tags)
+	if err != nil {
+		return nil, err
+	}
+	children[metaIdx].payload = newMeta
+
+	return encodeBoxes(children), nil
+}
+
+// rewriteMeta handles the "meta" box's quirk of a 4-byte version/flags
+// field before its child boxes begin.
+func rewriteMeta(payload []byte, tags TagSet) ([]byte, error) {
+	if len(payload) < 4 {
+		payload = make([]byte, 4)
+	}
+	prefix := payload[:4]
+
+	children, err := parseBoxes(payload[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	ilstIdx := indexOfBox(children, "ilst")
+	if ilstIdx == -1 {
+		children = append(children, mp4Box{typ: "ilst"})
+		ilstIdx = len(children) - 1
+	}
+
+	newIlst, err := rewriteIlst(children[ilstIdx].payload, tags)
+	if err != nil {
+		return nil, err
+	}
+	children[ilstIdx].payload = newIlst
+
+	out := make([]byte, 0, 4+len(payload))
+	out = append(out, prefix...)
+	out = append(out, encodeBoxes(children)...)
+	return out, nil
+}
+
+// rewriteIlst applies tags to the ilst item list: atoms that map to a
+// canonical DMCA field (directly or via a "----" freeform atom) are
+// replaced, removed, or left alone per tagAction, and every other item
+// (©gen, cprt, ...) passes through untouched. Canonical fields with no
+// existing item are appended if tags supplies a value.
+func rewriteIlst(payload []byte, tags TagSet) ([]byte, error) {
+	items, err := parseBoxes(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	sawLyrics := false
+	out := make([]mp4Box, 0, len(items)+len(canonicalTagNames))
+
+	for _, it := range items {
+		switch it.typ {
+		case atomCover:
+			if !tags.StripPictures {
+				out = append(out, it)
+			}
+			continue
+		case atomLyrics:
+			sawLyrics = true
+			if !tags.StripLyrics {
+				out = append(out, it)
+			} else if tags.ReplacementLyrics != "" {
+				out = append(out, buildTextAtom(atomLyrics, tags.ReplacementLyrics))
+			}
+			continue
+		}
+
+		name, ok := mp4AtomTagNames[it.typ]
+		if !ok && it.typ == atomFreeform {
+			name, ok = freeformTagName(it.payload)
+		}
+		if !ok {
+			out = append(out, it)
+			continue
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if value, touch := tagAction(name, tags); !touch {
+			out = append(out, it)
+		} else if value != "" {
+			out = append(out, buildTagAtom(name, value))
+		}
+	}
+
+	for _, name := range canonicalTagNames {
+		if seen[name] {
+			continue
+		}
+		if value, touch := tagAction(name, tags); touch && value != "" {
+			out = append(out, buildTagAtom(name, value))
+		}
+	}
+
+	if tags.StripPictures && len(tags.ReplacementCover) > 0 {
+		out = append(out, buildCoverAtom(tags.ReplacementCover, tags.ReplacementCoverMime))
+	}
+	if !sawLyrics && tags.StripLyrics && tags.ReplacementLyrics != "" {
+		out = append(out, buildTextAtom(atomLyrics, tags.ReplacementLyrics))
+	}
+
+	return encodeBoxes(out), nil
+}
+
+// buildTagAtom builds the ilst item for a canonical tag: a dedicated atom
+// if one exists (ARTIST, TITLE, ALBUM, DATE), or a "----" freeform atom
+// keyed by name otherwise (LABEL, ISRC).
+func buildTagAtom(name, value string) mp4Box {
+	data := mp4Box{typ: "data", payload: dataAtomPayload(value)}
+
+	if typ, ok := mp4Atoms[name]; ok {
+		return mp4Box{typ: typ, payload: encodeBoxes([]mp4Box{data})}
+	}
+
+	sub := []mp4Box{
+		{typ: "mean", payload: append([]byte{0, 0, 0, 0}, []byte(itunesMean)...)},
+		{typ: "name", payload: append([]byte{0, 0, 0, 0}, []byte(name)...)},
+		data,
+	}
+	return mp4Box{typ: atomFreeform, payload: encodeBoxes(sub)}
+}
+
+// buildTextAtom builds a plain iTunes text atom (a single "data" child
+// holding UTF-8 text), used for fields like ©lyr that aren't part of
+// TagSet's canonical fields.
+func buildTextAtom(typ, value string) mp4Box {
+	data := mp4Box{typ: "data", payload: dataAtomPayload(value)}
+	return mp4Box{typ: typ, payload: encodeBoxes([]mp4Box{data})}
+}
+
+// buildCoverAtom builds a "covr" atom holding raw image bytes in a "data"
+// child, using the iTunes well-known type code for the image's MIME type
+// where one is defined.
+func buildCoverAtom(data []byte, mime string) mp4Box {
+	typeCode := 0
+	switch mime {
+	case "image/jpeg":
+		typeCode = mp4DataTypeJPEG
+	case "image/png":
+		typeCode = mp4DataTypePNG
+	}
+
+	payload := make([]byte, 8, 8+len(data))
+	payload[3] = byte(typeCode)
+	payload = append(payload, data...)
+
+	return mp4Box{typ: atomCover, payload: encodeBoxes([]mp4Box{{typ: "data", payload: payload}})}
+}
+
+// freeformTagName reports the canonical tag name a "----" atom's payload
+// carries, if its mean is "com.apple.iTunes" and its name matches a
+// canonical field we know how to store there.
+func freeformTagName(payload []byte) (string, bool) {
+	subs, err := parseBoxes(payload)
+	if err != nil {
+		return "", false
+	}
+
+	var mean, name string
+	for _, s := range subs {
+		switch s.typ {
+		case "mean":
+			if len(s.payload) >= 4 {
+				mean = string(s.payload[4:])
+			}
+		case "name":
+			if len(s.payload) >= 4 {
+				name = string(s.payload[4:])
+			}
+		}
+	}
+
+	if mean != itunesMean || !isCanonicalTagName(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// dataAtomPayload builds an iTunes "data" atom body: a 4-byte type
+// indicator (a zero version byte, then a 3-byte well-known type, 1 = UTF-8
+// text), a 4-byte locale, then the raw text.
+func dataAtomPayload(value string) []byte {
+	out := make([]byte, 8, 8+len(value))
+	out[3] = 1 // well-known type: UTF-8 text
+	out = append(out, []byte(value)...)
+	return out
+}
+
+// mp4ChunkOffsetContainers are the box types that may contain a "stbl"
+// further down the tree (moov/trak/mdia/minf/stbl), so adjustChunkOffsets
+// recurses into them; anything else is left as an opaque leaf.
+var mp4ChunkOffsetContainers = map[string]bool{
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+}
+
+// adjustChunkOffsets walks payload looking for "stco"/"co64" chunk offset
+// tables nested under trak/mdia/minf/stbl and shifts every entry by delta,
+// leaving everything else untouched.
+func adjustChunkOffsets(payload []byte, delta int64) ([]byte, error) {
+	boxes, err := parseBoxes(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, b := range boxes {
+		switch {
+		case b.typ == "stco":
+			boxes[i].payload = adjustStco(b.payload, delta)
+		case b.typ == "co64":
+			boxes[i].payload = adjustCo64(b.payload, delta)
+		case mp4ChunkOffsetContainers[b.typ]:
+			adjusted, err := adjustChunkOffsets(b.payload, delta)
+			if err != nil {
+				return nil, err
+			}
+			boxes[i].payload = adjusted
+		}
+	}
+
+	return encodeBoxes(boxes), nil
+}
+
+// adjustStco shifts every 32-bit entry of an "stco" chunk offset table
+// (version/flags, then a 4-byte entry count, then that many 4-byte
+// big-endian offsets) by delta.
+func adjustStco(payload []byte, delta int64) []byte {
+	if len(payload) < 8 {
+		return payload
+	}
+	out := append([]byte(nil), payload...)
+
+	count := binary.BigEndian.Uint32(out[4:8])
+	for i := uint32(0); i < count; i++ {
+		off := 8 + i*4
+		if int(off+4) > len(out) {
+			break
+		}
+		v := int64(binary.BigEndian.Uint32(out[off:off+4])) + delta
+		binary.BigEndian.PutUint32(out[off:off+4], uint32(v))
+	}
+	return out
+}
+
+// adjustCo64 is adjustStco for the 64-bit variant of the chunk offset
+// table, used by files with chunks beyond the 4 GiB mark.
+func adjustCo64(payload []byte, delta int64) []byte {
+	if len(payload) < 8 {
+		return payload
+	}
+	out := append([]byte(nil), payload...)
+
+	count := binary.BigEndian.Uint32(out[4:8])
+	for i := uint32(0); i < count; i++ {
+		off := 8 + i*8
+		if int(off+8) > len(out) {
+			break
+		}
+		v := int64(binary.BigEndian.Uint64(out[off:off+8])) + delta
+		binary.BigEndian.PutUint64(out[off:off+8], uint64(v))
+	}
+	return out
+}
+
+func indexOfBox(boxes []mp4Box, typ string) int {
+	for i, b := range boxes {
+		if b.typ == typ {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseBoxes parses a flat run of boxes filling all of data.
+func parseBoxes(data []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("truncated box header")
+		}
+		size := int64(binary.BigEndian.Uint32(data[0:4]))
+		typ := string(data[4:8])
+		headerLen := 8
+
+		if size == 1 {
+			if len(data) < 16 {
+				return nil, fmt.Errorf("truncated 64-bit box size")
+			}
+			size = int64(binary.BigEndian.Uint64(data[8:16]))
+			headerLen = 16
+		} else if size == 0 {
+			size = int64(len(data))
+		}
+
+		if size < int64(headerLen) || size > int64(len(data)) {
+			return nil, fmt.Errorf("invalid box size for %q", typ)
+		}
+
+		boxes = append(boxes, mp4Box{typ: typ, payload: data[headerLen:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// encodeBoxes is the inverse of parseBoxes, except that every box is
+// written with a plain 32-bit size header: a box parsed from a 64-bit
+// size or a size of 0 (extends to end of data) comes back out with an
+// 8-byte header, and payloads over 4 GiB are not supported.
+func encodeBoxes(boxes []mp4Box) []byte {
+	var out []byte
+	for _, b := range boxes {
+		size := 8 + len(b.payload)
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header[0:4], uint32(size))
+		copy(header[4:8], b.typ)
+		out = append(out, header...)
+		out = append(out, b.payload...)
+	}
+	return out
+}
+
+func writeBoxes(w *os.File, boxes []mp4Box) error {
+	_, err := w.Write(encodeBoxes(boxes))
+	return err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+// buildStco builds a one-entry "stco" chunk offset table pointing at offset.
+func buildStco(offset uint32) []byte {
+	out := make([]byte, 12)
+	binary.BigEndian.PutUint32(out[4:8], 1) // entry count
+	binary.BigEndian.PutUint32(out[8:12], offset)
+	return out
+}
+
+// findChunkOffset digs moov/trak/mdia/minf/stbl/stco back out and returns
+// its single entry.
+func findChunkOffset(t *testing.T, moovPayload []byte) uint32 {
+	t.Helper()
+	payload := moovPayload
+	for _, typ := range []string{"trak", "mdia", "minf", "stbl"} {
+		boxes, err := parseBoxes(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx := indexOfBox(boxes, typ)
+		if idx == -1 {
+			t.Fatalf("missing %s box", typ)
+		}
+		payload = boxes[idx].payload
+	}
+
+	boxes, err := parseBoxes(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := indexOfBox(boxes, "stco")
+	if idx == -1 {
+		t.Fatal("missing stco box")
+	}
+	return binary.BigEndian.Uint32(boxes[idx].payload[8:12])
+}
+
+// TestMp4ChunkOffsetsShiftWithMoovSize builds a minimal faststart-style
+// M4A (moov before mdat) with a single-entry stco pointing at mdat's real
+// payload offset, strips tags that grow moov, and checks stco was shifted
+// to still point at mdat's new real offset rather than being left stale.
+func TestMp4ChunkOffsetsShiftWithMoovSize(t *testing.T) {
+	mdatPayload := []byte("AUDIOFRAMEDATA")
+
+	stbl := encodeBoxes([]mp4Box{{typ: "stco", payload: buildStco(0)}}) // placeholder offset, fixed below
+	minf := encodeBoxes([]mp4Box{{typ: "stbl", payload: stbl}})
+	mdia := encodeBoxes([]mp4Box{{typ: "minf", payload: minf}})
+	trak := encodeBoxes([]mp4Box{{typ: "mdia", payload: mdia}})
+	moov := encodeBoxes([]mp4Box{{typ: "trak", payload: trak}})
+
+	ftyp := mp4Box{typ: "ftyp", payload: []byte("M4A mp42isom")}
+	top := []mp4Box{ftyp, {typ: "moov", payload: moov}, {typ: "mdat", payload: mdatPayload}}
+
+	mdatOffset := uint32(8 + len(ftyp.payload) + 8 + len(moov) + 8)
+	stbl = encodeBoxes([]mp4Box{{typ: "stco", payload: buildStco(mdatOffset)}})
+	minf = encodeBoxes([]mp4Box{{typ: "stbl", payload: stbl}})
+	mdia = encodeBoxes([]mp4Box{{typ: "minf", payload: minf}})
+	trak = encodeBoxes([]mp4Box{{typ: "mdia", payload: mdia}})
+	moov = encodeBoxes([]mp4Box{{typ: "trak", payload: trak}})
+	top[1].payload = moov
+
+	if got := findChunkOffset(t, moov); got != mdatOffset {
+		t.Fatalf("test fixture is wrong: stco points at %d, mdat payload starts at %d", got, mdatOffset)
+	}
+
+	raw := encodeBoxes(top)
+
+	tmp := t.TempDir() + "/t.m4a"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tags := TagSet{
+		Artist: "A Much Longer Replacement Artist Name Than The Original",
+		Skip:   map[string]bool{"TITLE": true, "ALBUM": true, "DATE": true, "ISRC": true, "LABEL": true},
+	}
+	if err := (Mp4Tagger{}).Strip(tmp, tags); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTop, err := parseBoxes(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moovIdx := indexOfBox(newTop, "moov")
+	mdatIdx := indexOfBox(newTop, "mdat")
+	if moovIdx == -1 || mdatIdx == -1 {
+		t.Fatal("missing moov or mdat after strip")
+	}
+
+	if !bytes.Equal(newTop[mdatIdx].payload, mdatPayload) {
+		t.Fatalf("mdat payload corrupted: %q", newTop[mdatIdx].payload)
+	}
+
+	wantOffset := uint32(0)
+	for i := 0; i <= mdatIdx; i++ {
+		if i < mdatIdx {
+			wantOffset += uint32(8 + len(newTop[i].payload))
+		}
+	}
+	wantOffset += 8 // mdat's own header
+
+	gotOffset := findChunkOffset(t, newTop[moovIdx].payload)
+	if gotOffset != wantOffset {
+		t.Fatalf("stco entry = %d, want %d (mdat's real payload offset)", gotOffset, wantOffset)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// TagSet is the set of fields a Tagger writes when sanitizing a track. A
+// canonical field is replaced with its TagSet value unless its name
+// appears in Skip, in which case the tagger leaves whatever was already in
+// the file alone. Text fields not in canonicalTagNames are left untouched,
+// whether or not they're in Skip; embedded pictures and lyrics are handled
+// separately by StripPictures and StripLyrics below.
+type TagSet struct {
+	Artist string
+	Title  string
+	Album  string
+	Label  string
+	Date   string
+	ISRC   string
+
+	// Skip holds canonical tag names (e.g. "ARTIST") that should be left
+	// as-is rather than stripped or rewritten, per the config's
+	// strip-tags/preserve-tags lists.
+	Skip map[string]bool
+
+	// StripPictures and StripLyrics control whether embedded cover art
+	// and lyrics are removed, since both frequently carry their own
+	// copyright/attribution metadata independent of the text tags above.
+	// ReplacementCover/ReplacementCoverMime and ReplacementLyrics, if
+	// non-empty, are re-embedded in their place; otherwise the field is
+	// simply dropped.
+	StripPictures        bool
+	ReplacementCover     []byte
+	ReplacementCoverMime string
+	StripLyrics          bool
+	ReplacementLyrics    string
+}
+
+// canonicalTagNames are the DMCA-relevant fields a Tagger understands,
+// independent of how each format names its native frame/atom for them.
+var canonicalTagNames = []string{"ARTIST", "TITLE", "ALBUM", "LABEL", "DATE", "ISRC"}
+
+func isCanonicalTagName(name string) bool {
+	for _, n := range canonicalTagNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalTagValues maps each canonical tag name to the value tags holds
+// for it.
+func canonicalTagValues(tags TagSet) map[string]string {
+	return map[string]string{
+		"ARTIST": tags.Artist,
+		"TITLE":  tags.Title,
+		"ALBUM":  tags.Album,
+		"LABEL":  tags.Label,
+		"DATE":   tags.Date,
+		"ISRC":   tags.ISRC,
+	}
+}
+
+// pictureTypeFrontCover is the ID3v2/FLAC picture-type value for a front
+// cover image, used when embedding a replacement cover.
+const pictureTypeFrontCover = 3
+
+// lyricsCommentKeys lists the (non-canonical) Vorbis comment keys
+// FlacTagger treats as carrying lyrics, across the naming conventions
+// different tools use for the same field. Mp3Tagger and Mp4Tagger don't
+// consult it; they handle lyrics through the USLT frame and ©lyr atom.
+var lyricsCommentKeys = []string{"LYRICS", "UNSYNCEDLYRICS"}
+
+func isLyricsCommentKey(name string) bool {
+	for _, k := range lyricsCommentKeys {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// tagAction reports what a Tagger should do about the canonical field
+// name: if touch is false, the field must be left exactly as found in the
+// file. If touch is true, the field should be set to value, or removed
+// entirely if value is empty.
+func tagAction(name string, tags TagSet) (value string, touch bool) {
+	if tags.Skip[name] {
+		return "", false
+	}
+	return canonicalTagValues(tags)[name], true
+}
+
+// Tagger strips copyright-identifying metadata from an audio file in place
+// and replaces it with the station-supplied TagSet. Implementations must
+// only rewrite the tag/metadata structures of the file; audio data is left
+// byte-for-byte untouched.
+type Tagger interface {
+	Strip(path string, tags TagSet) error
+}
+
+// taggerForPath picks a Tagger based on the extension of name, which should
+// be the track's library path (TrackJSON.File_Path) rather than the
+// temporary file it's been downloaded to, since the latter has no
+// extension.
+func taggerForPath(name string) (Tagger, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".flac":
+		return FlacTagger{}, nil
+	case ".mp3":
+		return Mp3Tagger{}, nil
+	case ".m4a", ".mp4", ".aac":
+		return Mp4Tagger{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported audio format: %s", name)
+	}
+}